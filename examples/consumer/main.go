@@ -7,10 +7,16 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+const (
+	deliveryModeStream = "stream"
+	deliveryModePubSub = "pubsub"
+)
+
 func main() {
 	// Get Redis configuration from environment
 	redisAddr := os.Getenv("REDIS_ADDR")
@@ -23,6 +29,11 @@ func main() {
 		redisChannel = "starling_events"
 	}
 
+	deliveryMode := os.Getenv("REDIS_DELIVERY_MODE")
+	if deliveryMode != deliveryModeStream && deliveryMode != deliveryModePubSub {
+		deliveryMode = deliveryModeStream
+	}
+
 	// Create Redis client
 	rdb := redis.NewClient(&redis.Options{
 		Addr: redisAddr,
@@ -35,28 +46,33 @@ func main() {
 	}
 
 	log.Printf("Connected to Redis at %s", redisAddr)
-	log.Printf("Subscribing to channel: %s", redisChannel)
 
-	// Subscribe to the channel
-	pubsub := rdb.Subscribe(ctx, redisChannel)
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	if deliveryMode == deliveryModePubSub {
+		runPubSub(ctx, rdb, redisChannel, quit)
+		return
+	}
+
+	runStream(ctx, rdb, redisChannel, quit)
+}
+
+func runPubSub(ctx context.Context, rdb *redis.Client, channel string, quit <-chan os.Signal) {
+	log.Printf("Subscribing to channel: %s", channel)
+
+	pubsub := rdb.Subscribe(ctx, channel)
 	defer pubsub.Close()
 
 	// Wait for subscription confirmation
-	_, err := pubsub.Receive(ctx)
-	if err != nil {
+	if _, err := pubsub.Receive(ctx); err != nil {
 		log.Fatalf("Failed to subscribe: %v", err)
 	}
 
 	log.Println("Waiting for messages... (Press Ctrl+C to exit)")
 
-	// Create channel for messages
 	ch := pubsub.Channel()
 
-	// Handle graceful shutdown
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-
-	// Process messages
 	for {
 		select {
 		case msg := <-ch:
@@ -70,3 +86,108 @@ func main() {
 		}
 	}
 }
+
+// runStream consumes the event stream via a consumer group, acknowledging
+// each entry after processing and periodically reclaiming entries left
+// pending by consumers that crashed before acking.
+func runStream(ctx context.Context, rdb *redis.Client, stream string, quit <-chan os.Signal) {
+	group := os.Getenv("REDIS_CONSUMER_GROUP")
+	if group == "" {
+		group = "starling-consumers"
+	}
+
+	consumer := os.Getenv("REDIS_CONSUMER_NAME")
+	if consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "consumer-1"
+		}
+		consumer = hostname
+	}
+
+	claimIdle := 30 * time.Second
+
+	if err := rdb.XGroupCreateMkStream(ctx, stream, group, "0").Err(); err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
+		log.Fatalf("Failed to create consumer group: %v", err)
+	}
+
+	log.Printf("Reading stream %s as group %s, consumer %s", stream, group, consumer)
+	log.Println("Waiting for messages... (Press Ctrl+C to exit)")
+
+	done := make(chan struct{})
+	go func() {
+		<-quit
+		log.Println("Shutting down consumer...")
+		close(done)
+	}()
+
+	claimTicker := time.NewTicker(claimIdle)
+	defer claimTicker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-claimTicker.C:
+			reclaimStale(ctx, rdb, stream, group, consumer, claimIdle)
+		default:
+		}
+
+		res, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: consumer,
+			Streams:  []string{stream, ">"},
+			Count:    10,
+			Block:    2 * time.Second,
+		}).Result()
+		if err != nil {
+			if err != redis.Nil {
+				log.Printf("Error reading from stream: %v", err)
+			}
+			continue
+		}
+
+		for _, s := range res {
+			for _, msg := range s.Messages {
+				printEntry(msg)
+				if err := rdb.XAck(ctx, stream, group, msg.ID).Err(); err != nil {
+					log.Printf("Error acking entry %s: %v", msg.ID, err)
+				}
+			}
+		}
+	}
+}
+
+// reclaimStale claims pending entries that have sat idle longer than
+// claimIdle, handing crashed consumers' work back into rotation.
+func reclaimStale(ctx context.Context, rdb *redis.Client, stream, group, consumer string, claimIdle time.Duration) {
+	messages, _, err := rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   stream,
+		Group:    group,
+		Consumer: consumer,
+		MinIdle:  claimIdle,
+		Start:    "0",
+		Count:    100,
+	}).Result()
+	if err != nil {
+		log.Printf("Error reclaiming stale entries: %v", err)
+		return
+	}
+
+	for _, msg := range messages {
+		log.Printf("Reclaimed stale entry %s", msg.ID)
+		printEntry(msg)
+		if err := rdb.XAck(ctx, stream, group, msg.ID).Err(); err != nil {
+			log.Printf("Error acking reclaimed entry %s: %v", msg.ID, err)
+		}
+	}
+}
+
+func printEntry(msg redis.XMessage) {
+	fmt.Printf("\n=== Received Event ===\n")
+	fmt.Printf("ID: %s\n", msg.ID)
+	for k, v := range msg.Values {
+		fmt.Printf("%s: %v\n", k, v)
+	}
+	fmt.Println("===================")
+}
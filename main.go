@@ -2,19 +2,21 @@ package main
 
 import (
 	"context"
-	"crypto"
-	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
-	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -26,10 +28,58 @@ type Config struct {
 	Port          string
 	RedisAddr     string
 	RedisChannel  string
-	WebhookSecret string
 	RedisPassword string
+
+	// WebhookSecret is interpreted according to WebhookSigAlgo: a shared
+	// secret for hmac-sha512, or a base64-encoded PKIX/X.509 RSA public
+	// key for rsa-sha256.
+	WebhookSecret  string
+	WebhookSigAlgo string
+
+	RedisUsername string
+	RedisDB       int
+
+	// Sentinel configuration. When RedisSentinelAddrs is non-empty, the
+	// server connects through a failover client instead of a single node.
+	RedisSentinelAddrs    []string
+	RedisSentinelMaster   string
+	RedisSentinelPassword string
+
+	// Cluster configuration. When RedisClusterAddrs is non-empty, the
+	// server connects through a cluster client instead of a single node.
+	RedisClusterAddrs []string
+
+	// TLS configuration, applicable to all connection modes above.
+	RedisTLSEnabled bool
+	RedisCAFile     string
+
+	// RedisDeliveryMode selects how events are handed off to Redis:
+	// "stream" (default) uses XADD for at-least-once delivery, "pubsub"
+	// uses the legacy PUBLISH fire-and-forget path.
+	RedisDeliveryMode string
+	// RedisStreamMaxLen is the approximate cap applied to the stream via
+	// MAXLEN ~ N on every XADD, used only in stream delivery mode.
+	RedisStreamMaxLen int64
+
+	// IdempotencyTTL controls how long a processed event's dedupe key is
+	// retained; replays of the same eventId within this window are
+	// short-circuited without re-delivering.
+	IdempotencyTTL time.Duration
+
+	// MetricsPort is the port the /metrics endpoint is served on, as a
+	// separate HTTP server from the webhook/health listener.
+	MetricsPort string
+	// LogLevel is one of debug, info, warn, error (default info).
+	LogLevel string
+	// LogFormat is either json (default) or text.
+	LogFormat string
 }
 
+const (
+	deliveryModeStream = "stream"
+	deliveryModePubSub = "pubsub"
+)
+
 // WebhookEvent represents a generic Starling webhook event
 type WebhookEvent struct {
 	EventType        string          `json:"eventType"`
@@ -39,19 +89,104 @@ type WebhookEvent struct {
 	EventID          string          `json:"eventId,omitempty"`
 }
 
+// unknownEventTypeLabel is the metrics label value used for any eventType
+// outside knownEventTypes.
+const unknownEventTypeLabel = "unknown"
+
+// knownEventTypes allowlists the eventType values Starling is documented to
+// send. /webhook is internet-facing and serves unsigned requests whenever
+// WEBHOOK_SECRET is unset, so the raw eventType must never be used as a
+// Prometheus label directly: an attacker could otherwise drive unbounded
+// label cardinality by posting distinct values.
+var knownEventTypes = map[string]struct{}{
+	"TRANSACTION_FEED_ITEM_CREATED":    {},
+	"TRANSACTION_FEED_ITEM_UPDATED":    {},
+	"TRANSACTION_FEED_ITEM_DELETED":    {},
+	"CARD_CONTROLS_CHANGED":            {},
+	"SAVINGS_GOAL_TRANSFER_CREATED":    {},
+	"DIRECT_DEBIT_MANDATE_CREATED":     {},
+	"DIRECT_DEBIT_MANDATE_CANCELLED":   {},
+	"STANDING_ORDER_FEED_ITEM_CREATED": {},
+	"STANDING_ORDER_FEED_ITEM_UPDATED": {},
+}
+
+// eventTypeMetricLabel clamps an eventType to a bounded set of metric label
+// values, mapping anything not in knownEventTypes to unknownEventTypeLabel.
+// The unclamped value is still safe to log, since slog fields don't carry
+// the cardinality cost a Prometheus label does.
+func eventTypeMetricLabel(eventType string) string {
+	if _, ok := knownEventTypes[eventType]; ok {
+		return eventType
+	}
+	return unknownEventTypeLabel
+}
+
 // Server handles HTTP requests and publishes to Redis
 type Server struct {
 	config      *Config
-	redisClient *redis.Client
-	publicKey   *rsa.PublicKey
+	redisClient redis.UniversalClient
+	sigVerifier SignatureVerifier
+	metrics     *Metrics
+	logger      *slog.Logger
+}
+
+// newRedisClient builds a redis.UniversalClient appropriate for the
+// configured connection mode: sentinel-backed failover, cluster, or a
+// plain single-node client. Single-node is used when neither
+// RedisSentinelAddrs nor RedisClusterAddrs is set; if both are set,
+// sentinel takes precedence.
+func newRedisClient(config *Config) (redis.UniversalClient, error) {
+	var tlsConfig *tls.Config
+	if config.RedisTLSEnabled {
+		tlsConfig = &tls.Config{}
+		if config.RedisCAFile != "" {
+			caCert, err := os.ReadFile(config.RedisCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read Redis CA file: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caCert) {
+				return nil, errors.New("failed to parse Redis CA file")
+			}
+			tlsConfig.RootCAs = pool
+		}
+	}
+
+	switch {
+	case len(config.RedisSentinelAddrs) > 0:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       config.RedisSentinelMaster,
+			SentinelAddrs:    config.RedisSentinelAddrs,
+			SentinelPassword: config.RedisSentinelPassword,
+			Username:         config.RedisUsername,
+			Password:         config.RedisPassword,
+			DB:               config.RedisDB,
+			TLSConfig:        tlsConfig,
+		}), nil
+	case len(config.RedisClusterAddrs) > 0:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     config.RedisClusterAddrs,
+			Username:  config.RedisUsername,
+			Password:  config.RedisPassword,
+			TLSConfig: tlsConfig,
+		}), nil
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:      config.RedisAddr,
+			Username:  config.RedisUsername,
+			Password:  config.RedisPassword,
+			DB:        config.RedisDB,
+			TLSConfig: tlsConfig,
+		}), nil
+	}
 }
 
 // NewServer creates a new Server instance
 func NewServer(config *Config) (*Server, error) {
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     config.RedisAddr,
-		Password: config.RedisPassword,
-	})
+	redisClient, err := newRedisClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build Redis client: %w", err)
+	}
 
 	// Test the connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -61,11 +196,28 @@ func NewServer(config *Config) (*Server, error) {
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	log.Printf("Connected to Redis at %s", config.RedisAddr)
+	return NewServerWithClient(config, redisClient)
+}
+
+// NewServerWithClient constructs a Server around an already-connected
+// redis.UniversalClient, separating client construction from server
+// construction so tests can inject a fake (e.g. miniredis-backed) client
+// instead of dialing a live Redis process.
+func NewServerWithClient(config *Config, redisClient redis.UniversalClient) (*Server, error) {
+	logger := newLogger(config)
+	logger.Info("connected to Redis", "sentinel", len(config.RedisSentinelAddrs) > 0, "cluster", len(config.RedisClusterAddrs) > 0)
+
+	sigVerifier, err := newSignatureVerifier(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build signature verifier: %w", err)
+	}
 
 	return &Server{
 		config:      config,
 		redisClient: redisClient,
+		sigVerifier: sigVerifier,
+		metrics:     NewMetrics(),
+		logger:      logger,
 	}, nil
 }
 
@@ -74,108 +226,169 @@ func (s *Server) Close() error {
 	return s.redisClient.Close()
 }
 
-func (s *Server) initialiseKey() error {
-	// Decode the Base64 string from your config
-	der, err := base64.StdEncoding.DecodeString(s.config.WebhookSecret)
-	if err != nil {
-		return err
-	}
-
-	// Parse the PKIX/X.509 format
-	pub, err := x509.ParsePKIXPublicKey(der)
-	if err != nil {
-		return err
-	}
-
-	// Assert that it is indeed an RSA key
-	rsaPub, ok := pub.(*rsa.PublicKey)
-	if !ok {
-		return errors.New("not an RSA public key")
-	}
-
-	s.publicKey = rsaPub
-	return nil
-}
-
-func (s *Server) verifySignature(payload []byte, signature string) bool {
-	if s.config.WebhookSecret == "" {
-		return true
-	}
-
-	// 1. Decode the signature from the header
-	sigBytes, err := base64.StdEncoding.DecodeString(signature)
-	if err != nil {
-		return false
-	}
-
-	// 2. Hash the payload
-	// Most providers use SHA256 for RSA signatures
-	hash := sha256.Sum256(payload)
-
-	// 3. Verify using the Public Key
-	// We use rsa.VerifyPKCS1v15 for standard RSA signatures
-	err = rsa.VerifyPKCS1v15(s.publicKey, crypto.SHA256, hash[:], sigBytes)
-
-	return err == nil
-}
-
 // handleWebhook processes incoming webhook requests
 func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	requestID := requestIDFromContext(r.Context())
+
+	var eventType, accountHolderUID, eventID string
+	status := http.StatusOK
+
+	defer func() {
+		duration := time.Since(start)
+		s.metrics.processingDuration.Observe(duration.Seconds())
+		s.metrics.requestsTotal.WithLabelValues(eventTypeMetricLabel(eventType), strconv.Itoa(status)).Inc()
+		s.logger.Info("handled webhook",
+			"request_id", requestID,
+			"event_id", eventID,
+			"event_type", eventType,
+			"account_holder_uid", accountHolderUID,
+			"duration_ms", duration.Milliseconds(),
+			"status", status,
+		)
+	}()
+
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		status = http.StatusMethodNotAllowed
+		http.Error(w, "Method not allowed", status)
 		return
 	}
 
 	// Read the request body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		status = http.StatusBadRequest
+		s.logger.Error("error reading request body", "request_id", requestID, "error", err)
+		http.Error(w, "Bad request", status)
 		return
 	}
 
 	// Verify the signature
 	signature := r.Header.Get("X-Hook-Signature")
-	if !s.verifySignature(body, signature) {
-		log.Printf("Invalid signature for webhook")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if !s.sigVerifier.Verify(body, signature) {
+		status = http.StatusUnauthorized
+		s.metrics.signatureFailures.Inc()
+		s.logger.Warn("invalid signature for webhook", "request_id", requestID)
+		http.Error(w, "Unauthorized", status)
 		return
 	}
 
 	// Parse the webhook event
 	var event WebhookEvent
 	if err := json.Unmarshal(body, &event); err != nil {
-		log.Printf("Error parsing webhook event: %v", err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		status = http.StatusBadRequest
+		s.logger.Error("error parsing webhook event", "request_id", requestID, "error", err)
+		http.Error(w, "Bad request", status)
 		return
 	}
+	eventType = event.EventType
+	accountHolderUID = event.AccountHolderUID
+	eventID = event.EventID
 
-	// Publish to Redis
 	ctx := context.Background()
-	if err := s.redisClient.Publish(ctx, s.config.RedisChannel, body).Err(); err != nil {
-		log.Printf("Error publishing to Redis: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+
+	// Guard against Starling's at-least-once retry behaviour: skip
+	// delivery if we've already processed this event recently.
+	idempotencyKey := s.idempotencyKey(&event, body)
+	isNew, err := s.redisClient.SetNX(ctx, idempotencyKey, 1, s.config.IdempotencyTTL).Result()
+	if err != nil {
+		status = http.StatusInternalServerError
+		s.logger.Error("error checking idempotency key", "request_id", requestID, "key", idempotencyKey, "error", err)
+		http.Error(w, "Internal server error", status)
+		return
+	}
+	if !isNew {
+		s.logger.Info("duplicate webhook delivery skipped", "request_id", requestID, "key", idempotencyKey)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
 		return
 	}
 
-	log.Printf("Published event type %s to Redis channel %s", event.EventType, s.config.RedisChannel)
+	// Hand the event off to Redis
+	if err := s.deliver(ctx, &event, body); err != nil {
+		status = http.StatusInternalServerError
+		s.metrics.redisPublishFailures.Inc()
+		s.logger.Error("error delivering event to redis", "request_id", requestID, "error", err)
+		// Delivery never happened, so undo the idempotency guard: leaving
+		// it in place would make Starling's guaranteed retry look like a
+		// duplicate and the event would be dropped for the full TTL.
+		if delErr := s.redisClient.Del(ctx, idempotencyKey).Err(); delErr != nil {
+			s.logger.Error("error clearing idempotency key after failed delivery", "request_id", requestID, "key", idempotencyKey, "error", delErr)
+		}
+		http.Error(w, "Internal server error", status)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
 
+// idempotencyKey returns the Redis key used to deduplicate a webhook
+// delivery, keyed on eventId when present and falling back to a SHA-256
+// hash of the raw body otherwise.
+func (s *Server) idempotencyKey(event *WebhookEvent, body []byte) string {
+	if event.EventID != "" {
+		return "idempotency:" + event.EventID
+	}
+
+	sum := sha256.Sum256(body)
+	return "idempotency:" + hex.EncodeToString(sum[:])
+}
+
+// deliver hands a parsed webhook event off to Redis using the configured
+// delivery mode.
+func (s *Server) deliver(ctx context.Context, event *WebhookEvent, body []byte) error {
+	if s.config.RedisDeliveryMode == deliveryModePubSub {
+		return s.redisClient.Publish(ctx, s.config.RedisChannel, body).Err()
+	}
+
+	return s.redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.config.RedisChannel,
+		MaxLen: s.config.RedisStreamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"event_id":           event.EventID,
+			"event_type":         event.EventType,
+			"timestamp":          event.Timestamp,
+			"account_holder_uid": event.AccountHolderUID,
+			"payload":            body,
+		},
+	}).Err()
+}
+
 // handleHealth provides a health check endpoint
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	requestID := requestIDFromContext(r.Context())
+
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
 	if err := s.redisClient.Ping(ctx).Err(); err != nil {
+		s.metrics.redisUp.Set(0)
+		s.logger.Error("redis health check failed", "request_id", requestID, "error", err)
 		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
 		return
 	}
+	s.metrics.redisUp.Set(1)
+
+	health := struct {
+		Status       string `json:"status"`
+		StreamLength int64  `json:"stream_length,omitempty"`
+	}{Status: "OK"}
+
+	if s.config.RedisDeliveryMode != deliveryModePubSub {
+		length, err := s.redisClient.XLen(ctx, s.config.RedisChannel).Result()
+		if err != nil && err != redis.Nil {
+			s.logger.Error("error reading stream length", "request_id", requestID, "error", err)
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		health.StreamLength = length
+	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	json.NewEncoder(w).Encode(health)
 }
 
 // loadConfig loads configuration from environment variables
@@ -184,8 +397,35 @@ func loadConfig() *Config {
 		Port:          getEnv("PORT", "8080"),
 		RedisAddr:     getEnv("REDIS_ADDR", "localhost:6379"),
 		RedisChannel:  getEnv("REDIS_CHANNEL", "starling_events"),
-		WebhookSecret: getEnv("WEBHOOK_SECRET", ""),
 		RedisPassword: getEnv("REDIS_PASSWORD", ""),
+		RedisUsername: getEnv("REDIS_USERNAME", ""),
+		RedisDB:       getEnvInt("REDIS_DB", 0),
+
+		WebhookSecret:  getEnv("WEBHOOK_SECRET", ""),
+		WebhookSigAlgo: getEnv("WEBHOOK_SIG_ALGO", sigAlgoHMACSHA512),
+
+		RedisSentinelAddrs:    getEnvList("REDIS_SENTINEL_ADDRS"),
+		RedisSentinelMaster:   getEnv("REDIS_SENTINEL_MASTER", ""),
+		RedisSentinelPassword: getEnv("REDIS_SENTINEL_PASSWORD", ""),
+
+		RedisClusterAddrs: getEnvList("REDIS_CLUSTER_ADDRS"),
+
+		RedisTLSEnabled: getEnvBool("REDIS_TLS_ENABLED", false),
+		RedisCAFile:     getEnv("REDIS_CA_FILE", ""),
+
+		RedisDeliveryMode: getEnv("REDIS_DELIVERY_MODE", deliveryModeStream),
+		RedisStreamMaxLen: int64(getEnvInt("REDIS_STREAM_MAXLEN", 10000)),
+
+		IdempotencyTTL: getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+
+		MetricsPort: getEnv("METRICS_PORT", "9090"),
+		LogLevel:    getEnv("LOG_LEVEL", "info"),
+		LogFormat:   getEnv("LOG_FORMAT", "json"),
+	}
+
+	if config.RedisDeliveryMode != deliveryModeStream && config.RedisDeliveryMode != deliveryModePubSub {
+		log.Printf("Warning: unknown REDIS_DELIVERY_MODE %q; defaulting to %q", config.RedisDeliveryMode, deliveryModeStream)
+		config.RedisDeliveryMode = deliveryModeStream
 	}
 
 	if config.WebhookSecret == "" {
@@ -196,6 +436,10 @@ func loadConfig() *Config {
 		log.Println("Warning: REDIS_PASSWORD not set. Redis connection will be attempted without a password.")
 	}
 
+	if len(config.RedisSentinelAddrs) > 0 && len(config.RedisClusterAddrs) > 0 {
+		log.Println("Warning: both REDIS_SENTINEL_ADDRS and REDIS_CLUSTER_ADDRS set; sentinel takes precedence.")
+	}
+
 	return config
 }
 
@@ -207,6 +451,70 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvList gets a comma-separated environment variable as a string
+// slice, returning nil when unset or empty.
+func getEnvList(key string) []string {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return nil
+	}
+
+	parts := strings.Split(raw, ",")
+	addrs := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			addrs = append(addrs, p)
+		}
+	}
+	return addrs
+}
+
+// getEnvBool gets a boolean environment variable with a default value.
+func getEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Warning: invalid value for %s: %v; using default %v", key, err, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// getEnvDuration gets a duration environment variable with a default
+// value, parsed with time.ParseDuration (e.g. "24h", "30m").
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Warning: invalid value for %s: %v; using default %v", key, err, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// getEnvInt gets an integer environment variable with a default value.
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Warning: invalid value for %s: %v; using default %v", key, err, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
@@ -220,13 +528,9 @@ func main() {
 	}
 	defer server.Close()
 
-	if err := server.initialiseKey(); err != nil {
-		log.Fatalf("Failed to initialise key: %v", err)
-	}
-
 	// Set up HTTP handlers
-	http.HandleFunc("/webhook", server.handleWebhook)
-	http.HandleFunc("/health", server.handleHealth)
+	http.HandleFunc("/webhook", withRequestID(server.handleWebhook))
+	http.HandleFunc("/health", withRequestID(withMetrics(server.metrics, "health_check", server.handleHealth)))
 
 	// Create HTTP server
 	httpServer := &http.Server{
@@ -235,28 +539,44 @@ func main() {
 		WriteTimeout: 10 * time.Second,
 	}
 
-	// Start server in a goroutine
+	// Create metrics server
+	metricsServer := &http.Server{
+		Addr:    ":" + config.MetricsPort,
+		Handler: server.metrics.Handler(),
+	}
+
+	// Start servers in goroutines
 	go func() {
-		log.Printf("Starting server on port %s", config.Port)
+		server.logger.Info("starting server", "port", config.Port)
 		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server error: %v", err)
 		}
 	}()
 
+	go func() {
+		server.logger.Info("starting metrics server", "port", config.MetricsPort)
+		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			server.logger.Error("metrics server error", "error", err)
+		}
+	}()
+
 	// Wait for interrupt signal
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Println("Shutting down server...")
+	server.logger.Info("shutting down server")
 
 	// Graceful shutdown
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := httpServer.Shutdown(ctx); err != nil {
-		log.Printf("Server shutdown error: %v", err)
+		server.logger.Error("server shutdown error", "error", err)
+	}
+	if err := metricsServer.Shutdown(ctx); err != nil {
+		server.logger.Error("metrics server shutdown error", "error", err)
 	}
 
-	log.Println("Server stopped")
+	server.logger.Info("server stopped")
 }
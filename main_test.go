@@ -2,66 +2,27 @@ package main
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha512"
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/redis/go-redis/v9"
 )
 
-func TestVerifySignature(t *testing.T) {
-	config := &Config{
-		WebhookSecret: "test-secret",
-	}
-	server := &Server{
-		config: config,
-	}
-
-	payload := []byte(`{"eventType":"TEST"}`)
-
-	// Create valid signature
-	mac := hmac.New(sha512.New, []byte(config.WebhookSecret))
-	mac.Write(payload)
-	validSignature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
-
-	// Test valid signature
-	if !server.verifySignature(payload, validSignature) {
-		t.Error("Valid signature was rejected")
-	}
-
-	// Test invalid signature
-	if server.verifySignature(payload, "invalid-signature") {
-		t.Error("Invalid signature was accepted")
-	}
-}
-
-func TestVerifySignatureNoSecret(t *testing.T) {
-	config := &Config{
-		WebhookSecret: "",
-	}
-	server := &Server{
-		config: config,
-	}
-
-	payload := []byte(`{"eventType":"TEST"}`)
-
-	// Should accept any signature when no secret is configured
-	if !server.verifySignature(payload, "any-signature") {
-		t.Error("Signature check should pass when no secret is configured")
-	}
-}
-
 func TestHandleWebhookInvalidMethod(t *testing.T) {
 	config := &Config{
 		RedisChannel: "test",
 	}
 	server := &Server{
-		config: config,
+		config:      config,
+		sigVerifier: NewHMACSHA512Verifier(""),
+		metrics:     NewMetrics(),
+		logger:      newLogger(config),
 	}
 
 	req := httptest.NewRequest(http.MethodGet, "/webhook", nil)
@@ -80,7 +41,10 @@ func TestHandleWebhookInvalidJSON(t *testing.T) {
 		WebhookSecret: "",
 	}
 	server := &Server{
-		config: config,
+		config:      config,
+		sigVerifier: NewHMACSHA512Verifier(""),
+		metrics:     NewMetrics(),
+		logger:      newLogger(config),
 	}
 
 	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString("invalid json"))
@@ -103,6 +67,9 @@ func TestHandleHealth(t *testing.T) {
 	server := &Server{
 		config:      config,
 		redisClient: redis.NewClient(&redis.Options{Addr: config.RedisAddr}),
+		sigVerifier: NewHMACSHA512Verifier(""),
+		metrics:     NewMetrics(),
+		logger:      newLogger(config),
 	}
 
 	req := httptest.NewRequest(http.MethodGet, "/health", nil)
@@ -187,6 +154,226 @@ func TestWebhookEventParsing(t *testing.T) {
 	}
 }
 
+func TestEventTypeMetricLabelClampsUnknownValues(t *testing.T) {
+	if got := eventTypeMetricLabel("TRANSACTION_FEED_ITEM_CREATED"); got != "TRANSACTION_FEED_ITEM_CREATED" {
+		t.Errorf("expected known eventType to pass through, got %s", got)
+	}
+
+	for _, eventType := range []string{"TEST", "", "<script>alert(1)</script>", "TRANSACTION_FEED_ITEM_CREATED; DROP TABLE"} {
+		if got := eventTypeMetricLabel(eventType); got != unknownEventTypeLabel {
+			t.Errorf("expected unrecognized eventType %q to clamp to %q, got %q", eventType, unknownEventTypeLabel, got)
+		}
+	}
+}
+
+// newTestServer wires a Server to an embedded miniredis instance via
+// NewServerWithClient, so tests exercise real Redis semantics without a
+// live process.
+func newTestServer(t *testing.T, configure func(*Config)) (*Server, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	config := &Config{
+		RedisChannel:      "test-channel",
+		RedisDeliveryMode: deliveryModeStream,
+		IdempotencyTTL:    time.Hour,
+	}
+	if configure != nil {
+		configure(config)
+	}
+
+	server, err := NewServerWithClient(config, client)
+	if err != nil {
+		t.Fatalf("failed to construct test server: %v", err)
+	}
+
+	return server, mr
+}
+
+func TestHandleWebhookIdempotency(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+
+	payload := []byte(`{"eventType":"TEST","eventId":"abc-123"}`)
+
+	post := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+		w := httptest.NewRecorder()
+		server.handleWebhook(w, req)
+		return w.Code
+	}
+
+	if code := post(); code != http.StatusOK {
+		t.Fatalf("first delivery: expected status %d, got %d", http.StatusOK, code)
+	}
+	if code := post(); code != http.StatusOK {
+		t.Fatalf("replayed delivery: expected status %d, got %d", http.StatusOK, code)
+	}
+
+	length, err := server.redisClient.XLen(context.Background(), "test-channel").Result()
+	if err != nil {
+		t.Fatalf("checking stream length: %v", err)
+	}
+	if length != 1 {
+		t.Errorf("expected replayed payload to be delivered exactly once, stream length = %d", length)
+	}
+}
+
+func TestHandleWebhookIdempotencyFallsBackToBodyHash(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+
+	payload := []byte(`{"eventType":"TEST"}`)
+
+	first := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+	w1 := httptest.NewRecorder()
+	server.handleWebhook(w1, first)
+	if w1.Code != http.StatusOK {
+		t.Fatalf("first delivery: expected status %d, got %d", http.StatusOK, w1.Code)
+	}
+
+	key := server.idempotencyKey(&WebhookEvent{}, payload)
+	exists, err := server.redisClient.Exists(context.Background(), key).Result()
+	if err != nil {
+		t.Fatalf("checking idempotency key: %v", err)
+	}
+	if exists == 0 {
+		t.Errorf("expected idempotency key %s to be set", key)
+	}
+}
+
+func TestHandleWebhookDeliversExactBodyOnSubscribedChannel(t *testing.T) {
+	server, _ := newTestServer(t, func(c *Config) {
+		c.RedisDeliveryMode = deliveryModePubSub
+	})
+
+	sub := server.redisClient.Subscribe(context.Background(), server.config.RedisChannel)
+	defer sub.Close()
+	if _, err := sub.Receive(context.Background()); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	msgs := sub.Channel()
+
+	payload := []byte(`{"eventType":"TEST","eventId":"exact-body-1"}`)
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+	w := httptest.NewRecorder()
+	server.handleWebhook(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	select {
+	case msg := <-msgs:
+		if msg.Payload != string(payload) {
+			t.Errorf("expected published payload %q, got %q", payload, msg.Payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for published message")
+	}
+}
+
+// failOnceClient wraps a redis.UniversalClient and fails the first XAdd or
+// Publish call, then delegates to the real client for everything after
+// (including retries of the same command).
+type failOnceClient struct {
+	redis.UniversalClient
+	failed bool
+}
+
+func (c *failOnceClient) XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd {
+	if !c.failed {
+		c.failed = true
+		cmd := redis.NewStringCmd(ctx)
+		cmd.SetErr(errors.New("simulated xadd failure"))
+		return cmd
+	}
+	return c.UniversalClient.XAdd(ctx, a)
+}
+
+func (c *failOnceClient) Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd {
+	if !c.failed {
+		c.failed = true
+		cmd := redis.NewIntCmd(ctx)
+		cmd.SetErr(errors.New("simulated publish failure"))
+		return cmd
+	}
+	return c.UniversalClient.Publish(ctx, channel, message)
+}
+
+func TestHandleWebhookRollsBackIdempotencyKeyOnDeliveryFailure(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	failing := &failOnceClient{UniversalClient: server.redisClient}
+	server.redisClient = failing
+
+	payload := []byte(`{"eventType":"TEST","eventId":"retry-me"}`)
+
+	post := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+		w := httptest.NewRecorder()
+		server.handleWebhook(w, req)
+		return w.Code
+	}
+
+	if code := post(); code != http.StatusInternalServerError {
+		t.Fatalf("first delivery: expected status %d, got %d", http.StatusInternalServerError, code)
+	}
+
+	key := server.idempotencyKey(&WebhookEvent{EventID: "retry-me"}, payload)
+	exists, err := failing.UniversalClient.Exists(context.Background(), key).Result()
+	if err != nil {
+		t.Fatalf("checking idempotency key: %v", err)
+	}
+	if exists != 0 {
+		t.Fatalf("expected idempotency key %s to be cleared after failed delivery", key)
+	}
+
+	// Starling's retry of the same event should now be delivered, not
+	// dropped as a false-positive duplicate.
+	if code := post(); code != http.StatusOK {
+		t.Fatalf("retried delivery: expected status %d, got %d", http.StatusOK, code)
+	}
+
+	length, err := failing.UniversalClient.XLen(context.Background(), "test-channel").Result()
+	if err != nil {
+		t.Fatalf("checking stream length: %v", err)
+	}
+	if length != 1 {
+		t.Errorf("expected retried payload to be delivered exactly once, stream length = %d", length)
+	}
+}
+
+// TestHandleWebhookPublishFailureReturns500 isolates a Publish failure with
+// a healthy idempotency store: only the delivery call fails, not the
+// SetNX check that precedes it.
+func TestHandleWebhookPublishFailureReturns500(t *testing.T) {
+	server, _ := newTestServer(t, func(c *Config) {
+		c.RedisDeliveryMode = deliveryModePubSub
+	})
+	server.redisClient = &failOnceClient{UniversalClient: server.redisClient}
+
+	payload := []byte(`{"eventType":"TEST","eventId":"failure-1"}`)
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+	w := httptest.NewRecorder()
+	server.handleWebhook(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestHandleHealthReturns503WhenRedisStopped(t *testing.T) {
+	server, mr := newTestServer(t, nil)
+	mr.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	w := httptest.NewRecorder()
+	server.handleHealth(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
 func TestGetEnv(t *testing.T) {
 	// Test with default value
 	value := getEnv("NONEXISTENT_VAR", "default")
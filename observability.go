@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the Prometheus collectors used to instrument the webhook
+// server. Each Server owns its own registry so tests can assert against
+// a clean set of collectors instead of the global default registry.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	// requestsTotal is labelled with a clamped event_type (see
+	// eventTypeMetricLabel) so an unauthenticated caller can't drive
+	// unbounded label cardinality by varying the eventType it sends.
+	requestsTotal        *prometheus.CounterVec
+	signatureFailures    prometheus.Counter
+	redisPublishFailures prometheus.Counter
+	processingDuration   prometheus.Histogram
+	redisUp              prometheus.Gauge
+}
+
+// NewMetrics builds a Metrics instance registered against a fresh
+// registry.
+func NewMetrics() *Metrics {
+	registry := prometheus.NewRegistry()
+
+	m := &Metrics{
+		registry: registry,
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_requests_total",
+			Help: "Total number of webhook requests, by event type and HTTP status.",
+		}, []string{"event_type", "status"}),
+		signatureFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "webhook_signature_failures_total",
+			Help: "Total number of webhook requests rejected for an invalid signature.",
+		}),
+		redisPublishFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "webhook_redis_publish_failures_total",
+			Help: "Total number of failures delivering an event to Redis.",
+		}),
+		processingDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "webhook_processing_duration_seconds",
+			Help:    "Time taken to process a webhook request, in seconds.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		redisUp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "redis_up",
+			Help: "Whether the most recent Redis health check succeeded (1) or not (0).",
+		}),
+	}
+
+	registry.MustRegister(
+		m.requestsTotal,
+		m.signatureFailures,
+		m.redisPublishFailures,
+		m.processingDuration,
+		m.redisUp,
+	)
+
+	return m
+}
+
+// Handler returns the HTTP handler serving this Metrics' registry in the
+// Prometheus text exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// newLogger builds the structured logger used throughout the server,
+// configured by Config.LogLevel and Config.LogFormat.
+func newLogger(config *Config) *slog.Logger {
+	var level slog.Level
+	switch strings.ToLower(config.LogLevel) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn", "warning":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		level = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if strings.ToLower(config.LogFormat) == "text" {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	}
+
+	return slog.New(handler)
+}
+
+type contextKey string
+
+const requestIDContextKey contextKey = "request_id"
+
+// withRequestID propagates the X-Request-ID header through the request
+// context, generating one when the caller didn't supply it, and echoes
+// it back on the response.
+func withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = generateRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		ctx := context.WithValue(r.Context(), requestIDContextKey, requestID)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// statusRecordingResponseWriter captures the status code written by a
+// handler so withMetrics can label requestsTotal after the fact.
+type statusRecordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecordingResponseWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// withMetrics records webhook_requests_total and
+// webhook_processing_duration_seconds for any handler, labelling the
+// request with eventType. handleWebhook instruments itself directly
+// since it knows the event type parsed from the payload; this wraps
+// simpler handlers like handleHealth that don't have a payload to
+// introspect.
+func withMetrics(metrics *Metrics, eventType string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next(rec, r)
+
+		metrics.processingDuration.Observe(time.Since(start).Seconds())
+		metrics.requestsTotal.WithLabelValues(eventType, strconv.Itoa(rec.status)).Inc()
+	}
+}
+
+// requestIDFromContext returns the request ID stashed by withRequestID,
+// or an empty string if none is present.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// generateRequestID returns a random 16-byte hex-encoded identifier.
+func generateRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandlerExposesRegisteredCollectors(t *testing.T) {
+	m := NewMetrics()
+	m.requestsTotal.WithLabelValues("TEST_EVENT", "200").Inc()
+	m.signatureFailures.Inc()
+	m.redisUp.Set(1)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+
+	m.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	body := w.Body.String()
+	for _, want := range []string{
+		"webhook_requests_total",
+		"webhook_signature_failures_total",
+		"webhook_redis_publish_failures_total",
+		"webhook_processing_duration_seconds",
+		"redis_up 1",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected /metrics output to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestWithRequestIDGeneratesAndEchoesID(t *testing.T) {
+	var seen string
+	handler := withRequestID(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if seen == "" {
+		t.Error("expected a generated request ID in context")
+	}
+	if w.Header().Get("X-Request-ID") != seen {
+		t.Errorf("expected X-Request-ID header %q, got %q", seen, w.Header().Get("X-Request-ID"))
+	}
+}
+
+func TestWithMetricsRecordsRequestsAndDuration(t *testing.T) {
+	m := NewMetrics()
+	handler := withMetrics(m, "health_check", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	metricsReq := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	metricsW := httptest.NewRecorder()
+	m.Handler().ServeHTTP(metricsW, metricsReq)
+
+	body := metricsW.Body.String()
+	for _, want := range []string{
+		`webhook_requests_total{event_type="health_check",status="503"} 1`,
+		"webhook_processing_duration_seconds",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected /metrics output to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestWithRequestIDPropagatesIncomingHeader(t *testing.T) {
+	var seen string
+	handler := withRequestID(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("X-Request-ID", "incoming-id")
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if seen != "incoming-id" {
+		t.Errorf("expected request ID %q, got %q", "incoming-id", seen)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+)
+
+func TestHMACSHA512Verifier(t *testing.T) {
+	secret := "test-secret"
+	v := NewHMACSHA512Verifier(secret)
+
+	payload := []byte(`{"eventType":"TEST"}`)
+
+	mac := hmac.New(sha512.New, []byte(secret))
+	mac.Write(payload)
+	validSignature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	if !v.Verify(payload, validSignature) {
+		t.Error("valid HMAC signature was rejected")
+	}
+
+	if v.Verify(payload, "invalid-signature") {
+		t.Error("invalid HMAC signature was accepted")
+	}
+}
+
+func TestHMACSHA512VerifierNoSecret(t *testing.T) {
+	v := NewHMACSHA512Verifier("")
+
+	payload := []byte(`{"eventType":"TEST"}`)
+
+	if !v.Verify(payload, "any-signature") {
+		t.Error("signature check should pass when no secret is configured")
+	}
+}
+
+func TestRSAPKCS1v15Verifier(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	encodedKey := base64.StdEncoding.EncodeToString(der)
+
+	v, err := NewRSAPKCS1v15Verifier(encodedKey)
+	if err != nil {
+		t.Fatalf("failed to build verifier: %v", err)
+	}
+
+	payload := []byte(`{"eventType":"TEST"}`)
+	hash := sha256.Sum256(payload)
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatalf("failed to sign payload: %v", err)
+	}
+	validSignature := base64.StdEncoding.EncodeToString(sig)
+
+	if !v.Verify(payload, validSignature) {
+		t.Error("valid RSA signature was rejected")
+	}
+
+	if v.Verify(payload, base64.StdEncoding.EncodeToString([]byte("not-a-signature"))) {
+		t.Error("invalid RSA signature was accepted")
+	}
+}
+
+func TestRSAPKCS1v15VerifierMalformedKey(t *testing.T) {
+	if _, err := NewRSAPKCS1v15Verifier("not-valid-base64!!"); err == nil {
+		t.Error("expected error for malformed base64 key")
+	}
+
+	notDER := base64.StdEncoding.EncodeToString([]byte("not a der encoded key"))
+	if _, err := NewRSAPKCS1v15Verifier(notDER); err == nil {
+		t.Error("expected error for malformed DER key")
+	}
+}
+
+func TestNewSignatureVerifier(t *testing.T) {
+	v, err := newSignatureVerifier(&Config{WebhookSigAlgo: sigAlgoHMACSHA512, WebhookSecret: "s"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := v.(*HMACSHA512Verifier); !ok {
+		t.Errorf("expected *HMACSHA512Verifier, got %T", v)
+	}
+
+	v, err = newSignatureVerifier(&Config{WebhookSigAlgo: sigAlgoRSASHA256})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := v.(*RSAPKCS1v15Verifier); !ok {
+		t.Errorf("expected *RSAPKCS1v15Verifier, got %T", v)
+	}
+
+	if _, err := newSignatureVerifier(&Config{WebhookSigAlgo: "unknown-algo"}); err == nil {
+		t.Error("expected error for unknown signature algorithm")
+	}
+}